@@ -8,21 +8,51 @@ package yara
 #cgo LDFLAGS: -lyara
 #include <yara.h>
 
-void compiler_callback(int error_level, const char* file_name, int line_number, const char* message);
+void compiler_callback(int error_level, const char* file_name, int line_number, const char* message, void* user_data);
+const char* include_callback(const char* include_name, const char* calling_rule_filename, const char* calling_rule_namespace, void* user_data);
+void include_free_callback(const char* callback_result_ptr, void* user_data);
 */
 import "C"
 import (
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"unsafe"
 )
 
+// compilerCallbacks maps the handle passed to libyara as user_data
+// back to the *Compiler it was issued for, so that compilerCallback
+// can route diagnostics to the right Compiler even when multiple
+// compilers are in use concurrently from different goroutines. The
+// handle is a small C-allocated token rather than a disguised uintptr,
+// so that it can be handed to libyara as a void* without the
+// uintptr->unsafe.Pointer conversions that go vet's unsafeptr check
+// flags.
+var compilerCallbacks sync.Map // map[unsafe.Pointer]*Compiler
+
+func registerCompilerCallback(c *Compiler) unsafe.Pointer {
+	handle := C.malloc(1)
+	compilerCallbacks.Store(handle, c)
+	return handle
+}
+
+func unregisterCompilerCallback(handle unsafe.Pointer) {
+	compilerCallbacks.Delete(handle)
+	C.free(handle)
+}
+
 //export compilerCallback
-func compilerCallback(errorLevel C.int, filename *C.char, linenumber C.int, message *C.char) {
-	if currentCompiler == nil {
+func compilerCallback(errorLevel C.int, filename *C.char, linenumber C.int, message *C.char, userData unsafe.Pointer) {
+	v, ok := compilerCallbacks.Load(userData)
+	if !ok {
 		return
 	}
+	c := v.(*Compiler)
 	msg := CompilerMessage{
 		Filename: C.GoString(filename),
 		Line:     int(linenumber),
@@ -30,23 +60,46 @@ func compilerCallback(errorLevel C.int, filename *C.char, linenumber C.int, mess
 	}
 	switch errorLevel {
 	case C.YARA_ERROR_LEVEL_ERROR:
-		currentCompiler.Errors = append(currentCompiler.Errors, msg)
+		c.Errors = append(c.Errors, msg)
 	case C.YARA_ERROR_LEVEL_WARNING:
-		currentCompiler.Warnings = append(currentCompiler.Warnings, msg)
+		c.Warnings = append(c.Warnings, msg)
 	}
 }
 
-// FIXME: Get rid of this variable as soon as
-// https://github.com/plusvic/yara/issues/220 is fixed.
-var currentCompiler *Compiler
+// An IncludeCallbackFunc resolves an `include "..."` directive
+// encountered while compiling rules. name is the string that
+// appeared in the directive; callingRuleFilename and
+// callingRuleNamespace identify the file and namespace that
+// contained it. The returned ReadCloser is read to completion and
+// closed before the call returns.
+type IncludeCallbackFunc func(name, callingRuleFilename, callingRuleNamespace string) (io.ReadCloser, error)
 
 // A Compiler encapsulates the YARA compiler that transforms rules
 // into YARA's internal, binary form which in turn is used for
 // scanning files or memory blocks.
 type Compiler struct {
-	c        *C.YR_COMPILER
-	Errors   []CompilerMessage
-	Warnings []CompilerMessage
+	c                *C.YR_COMPILER
+	handle           unsafe.Pointer
+	includeCallback  IncludeCallbackFunc
+	warningsAsErrors bool
+	Errors           []CompilerMessage
+	Warnings         []CompilerMessage
+}
+
+// A CompileError is returned by AddString, AddFile, AddFD, and
+// AddReader when rules fail to compile. It carries every diagnostic
+// message produced for the call, not just the last one reported by
+// yr_compiler_get_error_message.
+type CompileError struct {
+	Messages []CompilerMessage
+}
+
+func (e *CompileError) Error() string {
+	lines := make([]string, len(e.Messages))
+	for i, m := range e.Messages {
+		lines[i] = fmt.Sprintf("%s: line %d: %s", m.Filename, m.Line, m.Text)
+	}
+	return strings.Join(lines, "\n")
 }
 
 // A CompilerMessage contains an error or warning message produced
@@ -60,62 +113,217 @@ type CompilerMessage struct {
 // NewCompiler creates a YARA compiler.
 func NewCompiler() (c *Compiler, err error) {
 	var compiler *C.YR_COMPILER
-	err = newError(C.yr_compiler_create(&compiler))
-	C.yr_compiler_set_callback(compiler, C.YR_COMPILER_CALLBACK_FUNC(C.compiler_callback))
-	if err == nil {
-		c = &Compiler{c: compiler}
-		runtime.SetFinalizer(c, func(c *Compiler) {
-			C.yr_compiler_destroy(c.c)
-			c.c = nil
-		})
+	if err = newError(C.yr_compiler_create(&compiler)); err != nil {
+		return
 	}
+	c = &Compiler{c: compiler}
+	c.handle = registerCompilerCallback(c)
+	C.yr_compiler_set_callback(
+		compiler,
+		C.YR_COMPILER_CALLBACK_FUNC(C.compiler_callback),
+		c.handle)
+	runtime.SetFinalizer(c, func(c *Compiler) {
+		unregisterCompilerCallback(c.handle)
+		C.yr_compiler_destroy(c.c)
+		c.c = nil
+	})
 	return
 }
 
+// compileResult turns the CompilerMessages appended to c.Errors and
+// c.Warnings during a call to AddString, AddFile, AddFD, or AddReader
+// into a *CompileError, or nil if the call produced no errors (and,
+// if SetWarningsAsErrors is in effect, no warnings either). The
+// returned CompileError always carries every diagnostic from the
+// call, errors and warnings alike, so callers can inspect all of them
+// regardless of which one caused the failure.
+func (c *Compiler) compileResult(numErrors, errorsBefore, warningsBefore int) error {
+	if numErrors == 0 && (!c.warningsAsErrors || len(c.Warnings) == warningsBefore) {
+		return nil
+	}
+	msgs := append([]CompilerMessage{}, c.Errors[errorsBefore:]...)
+	msgs = append(msgs, c.Warnings[warningsBefore:]...)
+	return &CompileError{Messages: msgs}
+}
+
+// SetWarningsAsErrors controls whether warnings produced while
+// compiling rules (e.g. a slow-regex warning) cause AddString,
+// AddFile, AddFD, and AddReader to fail as if they were errors.
+// This is useful when compiling untrusted rules and wanting to fail
+// closed instead of silently accepting a ruleset with warnings.
+func (c *Compiler) SetWarningsAsErrors(yes bool) {
+	c.warningsAsErrors = yes
+}
+
+// SetMaxStringsPerRule overrides libyara's limit on the number of
+// strings that a single rule may declare. As with every
+// yr_set_configuration knob, this setting is process-wide rather
+// than per-compiler, so it should be set once, before any rules are
+// compiled.
+func (c *Compiler) SetMaxStringsPerRule(n int) error {
+	v := C.uint32_t(n)
+	return newError(C.yr_set_configuration(C.YR_CONFIG_MAX_STRINGS_PER_RULE, unsafe.Pointer(&v)))
+}
+
+// SetMaxMatchData overrides libyara's limit on the number of bytes
+// of matching data that are retained per match. See
+// SetMaxStringsPerRule for a note on its process-wide scope.
+func (c *Compiler) SetMaxMatchData(n int) error {
+	v := C.uint32_t(n)
+	return newError(C.yr_set_configuration(C.YR_CONFIG_MAX_MATCH_DATA, unsafe.Pointer(&v)))
+}
+
 // AddFile compiles rules from an os.File. Rules are added to the
 // specified namespace.
 func (c *Compiler) AddFile(file os.File, namespace string) (err error) {
-	fh, err := C.fdopen(C.int(file.Fd()), C.CString("r"))
+	mode := C.CString("r")
+	defer C.free(unsafe.Pointer(mode))
+	fh, err := C.fdopen(C.int(file.Fd()), mode)
 	if err != nil {
 		return err
 	}
-	defer C.free(unsafe.Pointer(fh))
+	defer C.fclose(fh)
 	var ns *C.char
 	if namespace != "" {
 		ns = C.CString(namespace)
+		defer C.free(unsafe.Pointer(ns))
 	}
 	filename := C.CString(file.Name())
-	currentCompiler = c
-	defer func() { currentCompiler = nil }()
+	defer C.free(unsafe.Pointer(filename))
+	errorsBefore := len(c.Errors)
+	warningsBefore := len(c.Warnings)
 	numErrors := int(C.yr_compiler_add_file(c.c, fh, ns, filename))
-	if numErrors > 0 {
-		var buf [1024]C.char
-		msg := C.GoString(C.yr_compiler_get_error_message(
-			c.c, (*C.char)(unsafe.Pointer(&buf[0])), 1024))
-		err = errors.New(msg)
+	err = c.compileResult(numErrors, errorsBefore, warningsBefore)
+	return
+}
+
+// AddFD compiles rules read directly from a Unix file descriptor,
+// bypassing the libc FILE* dance that AddFile has to go through.
+// Rules are added to the specified namespace; filename is used only
+// to annotate error and warning messages.
+func (c *Compiler) AddFD(fd uintptr, namespace, filename string) (err error) {
+	var ns *C.char
+	if namespace != "" {
+		ns = C.CString(namespace)
+		defer C.free(unsafe.Pointer(ns))
 	}
+	var fn *C.char
+	if filename != "" {
+		fn = C.CString(filename)
+		defer C.free(unsafe.Pointer(fn))
+	}
+	errorsBefore := len(c.Errors)
+	warningsBefore := len(c.Warnings)
+	numErrors := int(C.yr_compiler_add_fd(c.c, C.int(fd), ns, fn))
+	err = c.compileResult(numErrors, errorsBefore, warningsBefore)
 	return
 }
 
+// AddReader compiles rules read from r, adding them to the specified
+// namespace. If r is backed by an *os.File its descriptor is handed
+// to AddFD directly; otherwise r is drained into a temporary file
+// first, since libyara's compiler only accepts file descriptors or
+// in-memory strings.
+func (c *Compiler) AddReader(r io.Reader, namespace, filename string) (err error) {
+	if f, ok := r.(*os.File); ok {
+		return c.AddFD(f.Fd(), namespace, filename)
+	}
+	tmp, err := ioutil.TempFile("", "go-yara")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err = io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return c.AddFD(tmp.Fd(), namespace, filename)
+}
+
 // AddString compiles rules from a string. Rules are added to the
 // specified namespace.
 func (c *Compiler) AddString(rules string, namespace string) (err error) {
 	var ns *C.char
 	if namespace != "" {
 		ns = C.CString(namespace)
+		defer C.free(unsafe.Pointer(ns))
 	}
-	currentCompiler = c
-	defer func() { currentCompiler = nil }()
-	numErrors := int(C.yr_compiler_add_string(c.c, C.CString(rules), ns))
-	if numErrors > 0 {
-		var buf [1024]C.char
-		msg := C.GoString(C.yr_compiler_get_error_message(
-			c.c, (*C.char)(unsafe.Pointer(&buf[0])), 1024))
-		err = errors.New(msg)
-	}
+	rulesC := C.CString(rules)
+	defer C.free(unsafe.Pointer(rulesC))
+	errorsBefore := len(c.Errors)
+	warningsBefore := len(c.Warnings)
+	numErrors := int(C.yr_compiler_add_string(c.c, rulesC, ns))
+	err = c.compileResult(numErrors, errorsBefore, warningsBefore)
 	return
 }
 
+//export includeCallback
+func includeCallback(includeName, callingRuleFilename, callingRuleNamespace *C.char, userData unsafe.Pointer) *C.char {
+	v, ok := compilerCallbacks.Load(userData)
+	if !ok {
+		return nil
+	}
+	c := v.(*Compiler)
+	if c.includeCallback == nil {
+		return nil
+	}
+	rc, err := c.includeCallback(
+		C.GoString(includeName),
+		C.GoString(callingRuleFilename),
+		C.GoString(callingRuleNamespace))
+	if err != nil {
+		c.Errors = append(c.Errors, CompilerMessage{
+			Filename: C.GoString(includeName),
+			Text:     err.Error(),
+		})
+		return nil
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		c.Errors = append(c.Errors, CompilerMessage{
+			Filename: C.GoString(includeName),
+			Text:     err.Error(),
+		})
+		return nil
+	}
+	// libyara reads the returned buffer as a NUL-terminated C string
+	// (it's fed straight into the flex lexer), so it must be
+	// NUL-terminated rather than just the raw, unterminated bytes
+	// C.CBytes would give us.
+	return C.CString(string(data))
+}
+
+//export includeFreeCallback
+func includeFreeCallback(callbackResult *C.char, userData unsafe.Pointer) {
+	C.free(unsafe.Pointer(callbackResult))
+}
+
+// SetIncludeCallback registers a function that is invoked whenever
+// the compiler encounters an `include "..."` directive, allowing
+// rule sets to be assembled from sources other than the filesystem —
+// an in-memory VFS, a zip bundle, a Go embed.FS tree, or a remote
+// store. Calling SetIncludeCallback again replaces the previous
+// callback.
+func (c *Compiler) SetIncludeCallback(cb IncludeCallbackFunc) {
+	c.includeCallback = cb
+	C.yr_compiler_set_include_callback(
+		c.c,
+		C.YR_COMPILER_INCLUDE_CALLBACK_FUNC(C.include_callback),
+		C.YR_COMPILER_INCLUDE_FREE_FUNC(C.include_free_callback),
+		c.handle)
+}
+
+// DisableIncludes turns off support for `include` directives
+// altogether; any rule source that uses one will fail to compile.
+func (c *Compiler) DisableIncludes() {
+	c.includeCallback = nil
+	C.yr_compiler_set_include_callback(c.c, nil, nil, nil)
+}
+
 // DefineVariable defines a named variable for use by the compiler.
 // Boolean, int64, and string types are supported.
 func (c *Compiler) DefineVariable(name string, value interface{}) (err error) {
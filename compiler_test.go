@@ -0,0 +1,45 @@
+// Copyright © 2015 Hilko Bengen <bengen@hilluzination.de>. All rights reserved.
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package yara
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestCompilerConcurrent compiles rules from many goroutines at once
+// and checks that each Compiler only ever sees the diagnostics that
+// belong to it, which would not hold if compilerCallback still routed
+// through a single shared currentCompiler variable.
+func TestCompilerConcurrent(t *testing.T) {
+	const n = 64
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			c, err := NewCompiler()
+			if err != nil {
+				t.Errorf("NewCompiler: %s", err)
+				return
+			}
+			rule := fmt.Sprintf("rule t%d { condition: true }", i)
+			if err := c.AddString(rule, ""); err != nil {
+				t.Errorf("AddString: %s", err)
+				return
+			}
+			if len(c.Errors) != 0 {
+				t.Errorf("compiler %d picked up %d errors that don't belong to it", i, len(c.Errors))
+			}
+			bad := fmt.Sprintf("rule t%d { condition: nonexistent }", i)
+			c.AddString(bad, "")
+			if len(c.Errors) == 0 {
+				t.Errorf("compiler %d did not record its own error", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,126 @@
+// Copyright © 2015 Hilko Bengen <bengen@hilluzination.de>. All rights reserved.
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package yara
+
+/*
+#include <yara.h>
+
+size_t stream_read_callback(void* ptr, size_t size, size_t count, void* user_data);
+size_t stream_write_callback(const void* ptr, size_t size, size_t count, void* user_data);
+*/
+import "C"
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// A Rules object represents a compiled ruleset, as returned by
+// (*Compiler).GetRules, LoadRules, or LoadRulesBuffer.
+type Rules struct {
+	r *C.YR_RULES
+}
+
+// streamHandles maps the handle passed to libyara as a YR_STREAM's
+// user_data back to the io.Reader or io.Writer that
+// stream_read_callback / stream_write_callback should use. As with
+// the compiler callbacks, the handle is a small C-allocated token
+// rather than a disguised uintptr, so it can be handed to libyara as
+// a void* without the uintptr->unsafe.Pointer conversions that go
+// vet's unsafeptr check flags.
+var streamHandles sync.Map // map[unsafe.Pointer]interface{}
+
+func registerStreamHandle(v interface{}) unsafe.Pointer {
+	handle := C.malloc(1)
+	streamHandles.Store(handle, v)
+	return handle
+}
+
+func unregisterStreamHandle(handle unsafe.Pointer) {
+	streamHandles.Delete(handle)
+	C.free(handle)
+}
+
+//export streamReadCallback
+func streamReadCallback(ptr unsafe.Pointer, size, count C.size_t, userData unsafe.Pointer) C.size_t {
+	if size == 0 {
+		return 0
+	}
+	v, ok := streamHandles.Load(userData)
+	if !ok {
+		return 0
+	}
+	r := v.(io.Reader)
+	buf := unsafe.Slice((*byte)(ptr), int(size*count))
+	n, _ := io.ReadFull(r, buf)
+	return C.size_t(n) / size
+}
+
+//export streamWriteCallback
+func streamWriteCallback(ptr unsafe.Pointer, size, count C.size_t, userData unsafe.Pointer) C.size_t {
+	if size == 0 {
+		return 0
+	}
+	v, ok := streamHandles.Load(userData)
+	if !ok {
+		return 0
+	}
+	w := v.(io.Writer)
+	buf := unsafe.Slice((*byte)(ptr), int(size*count))
+	n, _ := w.Write(buf)
+	return C.size_t(n) / size
+}
+
+// Save writes the compiled ruleset to w in YARA's native binary
+// format. The result can later be turned back into a *Rules with
+// LoadRules, without recompiling the original sources.
+func (r *Rules) Save(w io.Writer) (err error) {
+	handle := registerStreamHandle(w)
+	defer unregisterStreamHandle(handle)
+	stream := C.YR_STREAM{
+		user_data: handle,
+		write:     C.YR_STREAM_WRITE_FUNC(C.stream_write_callback),
+	}
+	return newError(C.yr_rules_save_stream(r.r, &stream))
+}
+
+// WriteBuffer serializes the compiled ruleset and returns it as a
+// byte slice.
+func (r *Rules) WriteBuffer() (buf []byte, err error) {
+	var b bytes.Buffer
+	if err = r.Save(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// LoadRules reads a compiled ruleset previously written with Save or
+// WriteBuffer.
+func LoadRules(r io.Reader) (rules *Rules, err error) {
+	handle := registerStreamHandle(r)
+	defer unregisterStreamHandle(handle)
+	stream := C.YR_STREAM{
+		user_data: handle,
+		read:      C.YR_STREAM_READ_FUNC(C.stream_read_callback),
+	}
+	var yr *C.YR_RULES
+	if err = newError(C.yr_rules_load_stream(&stream, &yr)); err != nil {
+		return nil, err
+	}
+	rules = &Rules{r: yr}
+	runtime.SetFinalizer(rules, func(rules *Rules) {
+		C.yr_rules_destroy(rules.r)
+		rules.r = nil
+	})
+	return rules, nil
+}
+
+// LoadRulesBuffer reads a compiled ruleset from an in-memory buffer
+// previously produced by WriteBuffer.
+func LoadRulesBuffer(buf []byte) (*Rules, error) {
+	return LoadRules(bytes.NewReader(buf))
+}
@@ -0,0 +1,41 @@
+// Copyright © 2015 Hilko Bengen <bengen@hilluzination.de>. All rights reserved.
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package yara
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRulesSaveLoadRoundTrip(t *testing.T) {
+	rules, err := Compile(`rule t { strings: $a = "foo" condition: $a }`, nil)
+	if err != nil {
+		t.Fatalf("Compile: %s", err)
+	}
+
+	buf, err := rules.WriteBuffer()
+	if err != nil {
+		t.Fatalf("WriteBuffer: %s", err)
+	}
+	if len(buf) == 0 {
+		t.Fatal("WriteBuffer returned an empty buffer")
+	}
+
+	loaded, err := LoadRulesBuffer(buf)
+	if err != nil {
+		t.Fatalf("LoadRulesBuffer: %s", err)
+	}
+	if loaded == nil {
+		t.Fatal("LoadRulesBuffer returned a nil *Rules")
+	}
+
+	var streamed bytes.Buffer
+	if err := rules.Save(&streamed); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+	if _, err := LoadRules(&streamed); err != nil {
+		t.Fatalf("LoadRules: %s", err)
+	}
+}